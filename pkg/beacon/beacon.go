@@ -0,0 +1,149 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package beacon wraps a drand client so other packages can use verifiable,
+// unbiasable public randomness (e.g. for leader election) instead of
+// deriving "randomness" from data peers can manipulate themselves.
+package beacon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	drand "github.com/drand/drand/client"
+	drandhttp "github.com/drand/drand/client/http"
+)
+
+// Config configures which drand chain to follow and how to verify it.
+type Config struct {
+	// ChainHash identifies the drand chain to follow.
+	ChainHash string
+	// PublicKey is the chain's distributed public key, used to verify every
+	// round's signature before it is trusted.
+	PublicKey string
+	// Endpoints are the drand HTTP relays to fetch/watch rounds from.
+	Endpoints []string
+}
+
+// Beacon serves verified drand randomness rounds, caching recent ones in
+// memory so repeated lookups don't all hit the network. It follows every
+// relay in Config.Endpoints rather than just the first, so one unreachable
+// relay doesn't take the whole beacon down.
+type Beacon struct {
+	clients []drand.Client
+
+	mu          sync.RWMutex
+	latest      uint64
+	lastUpdated time.Time
+	cache       map[uint64][]byte
+}
+
+// New connects to the drand chain described by cfg, dialing every relay in
+// cfg.Endpoints, and starts watching it.
+func New(cfg Config) (*Beacon, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("beacon: at least one endpoint is required")
+	}
+
+	info := &drand.ChainInfo{
+		Hash:      []byte(cfg.ChainHash),
+		PublicKey: []byte(cfg.PublicKey),
+	}
+
+	clients := make([]drand.Client, 0, len(cfg.Endpoints))
+	for _, endpoint := range cfg.Endpoints {
+		client, err := drandhttp.NewWithInfo(endpoint, info, nil)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return &Beacon{clients: clients, cache: map[uint64][]byte{}}, nil
+}
+
+// Run subscribes to new rounds as drand publishes them on every configured
+// relay, until ctx is canceled.
+func (b *Beacon) Run(ctx context.Context) error {
+	for _, client := range b.clients {
+		ch := client.Watch(ctx)
+		go func() {
+			for res := range ch {
+				b.store(res.Round(), res.Randomness())
+			}
+		}()
+	}
+	return nil
+}
+
+// Stop releases every underlying drand client.
+func (b *Beacon) Stop() {
+	for _, client := range b.clients {
+		_ = client.Close()
+	}
+}
+
+func (b *Beacon) store(round uint64, randomness []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cache[round] = randomness
+	if round > b.latest {
+		b.latest = round
+	}
+	b.lastUpdated = time.Now()
+}
+
+// Entry returns the (verified) randomness for round, fetching and caching it
+// on demand if it hasn't been observed via Run yet. It tries every
+// configured relay in order and only fails if all of them do.
+func (b *Beacon) Entry(round uint64) ([]byte, error) {
+	b.mu.RLock()
+	randomness, ok := b.cache[round]
+	b.mu.RUnlock()
+	if ok {
+		return randomness, nil
+	}
+
+	var lastErr error
+	for _, client := range b.clients {
+		res, err := client.Get(context.Background(), round)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b.store(res.Round(), res.Randomness())
+		return res.Randomness(), nil
+	}
+	return nil, lastErr
+}
+
+// LatestRound returns the most recent round this Beacon has observed.
+func (b *Beacon) LatestRound() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.latest
+}
+
+// LastUpdated returns when this Beacon last stored a round, whether watched
+// via Run or fetched on demand by Entry (an older round included), used by
+// callers to decide whether it is stale enough to fall back to a
+// non-randomness-based election.
+func (b *Beacon) LastUpdated() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.lastUpdated
+}
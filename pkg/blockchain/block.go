@@ -0,0 +1,67 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package blockchain
+
+import "encoding/json"
+
+// Data is a single ledger bucket entry, kept as its canonically marshalled
+// bytes so it can be hashed into a Merkle leaf without knowing its concrete
+// type; callers unmarshal it into whatever they expect.
+type Data []byte
+
+// Bytes returns d's raw encoded bytes, the value half of the Merkle leaf
+// computed over a bucket entry.
+func (d Data) Bytes() []byte {
+	return []byte(d)
+}
+
+// Unmarshal decodes d into v.
+func (d Data) Unmarshal(v interface{}) error {
+	return json.Unmarshal(d, v)
+}
+
+// newData canonically encodes v into a Data entry.
+func newData(v interface{}) (Data, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Data(b), nil
+}
+
+// Block is a single entry of the replicated ledger: a full snapshot of
+// every bucket's contents at Index, stamped with the Merkle root of that
+// snapshot so peers can verify a synced or pubsub-broadcast block without
+// trusting whoever sent it (see blockchain/sync and blockchain/odr).
+type Block struct {
+	// Index is this block's height; blocks are appended contiguously.
+	Index int
+	// Timestamp is when this block was mined, as Unix seconds.
+	Timestamp int64
+	// Storage holds every bucket's entries as of this block.
+	Storage map[string]map[string]Data
+	// MerkleRoot is MerkleRoot(canonicalized Storage), recomputed and
+	// checked by every receiver before the block is trusted.
+	MerkleRoot []byte
+	// PrevHash links this block to the one before it.
+	PrevHash string
+	// Validator is the peer ID that mined this block.
+	Validator string
+	// Signature is Validator's signature over the block. It is checked only
+	// once projected into a light.Header (see light.verifyHeaderSignature);
+	// Ledger.AppendBlock does not check it.
+	Signature []byte
+}
@@ -0,0 +1,314 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package blockchain implements the replicated, block-structured ledger
+// every node's services/users/healthcheck data lives in. Writes (Add) are
+// mined into the current block and re-stamp its Merkle root immediately;
+// blocks arriving from elsewhere (blockchain/sync, or a node's own pubsub
+// tail) only ever enter through AppendBlock, which independently recomputes
+// and checks that root before accepting them.
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// odrCacheTTL bounds how long a light Ledger trusts a previously
+// ODR-fetched value before re-fetching and re-verifying it.
+const odrCacheTTL = 10 * time.Second
+
+// ODRClient fetches a single bucket entry from a full peer, verifying it
+// against a locally trusted header before returning it - satisfied by
+// pkg/blockchain/odr.Client. A light Ledger falls back to one from GetKey
+// once EnableLightMode has supplied it (see pkg/blockchain/odr.Mode);
+// CurrentData never calls it.
+type ODRClient interface {
+	GetValue(peerID, bucket, key string) ([]byte, error)
+}
+
+// odrCacheEntry is a previously fetched light-mode value.
+type odrCacheEntry struct {
+	value     Data
+	fetchedAt time.Time
+}
+
+// Ledger is the replicated, block-structured key/value store every node
+// reads and writes its state through.
+type Ledger struct {
+	mu     sync.RWMutex
+	blocks []*Block
+
+	light    bool
+	odr      ODRClient
+	odrPeers func() []string
+	cache    map[string]odrCacheEntry
+}
+
+// New creates a Ledger seeded with an empty genesis block.
+func New() *Ledger {
+	genesis := &Block{Storage: map[string]map[string]Data{}}
+	genesis.MerkleRoot, _ = MerkleRoot(nil)
+	return &Ledger{blocks: []*Block{genesis}, cache: map[string]odrCacheEntry{}}
+}
+
+// SetLightMode toggles whether this Ledger indexes writes locally (full
+// mode) or drops them, reading back through whatever ODRClient
+// EnableLightMode has supplied (light mode). The Ledger does not send a
+// dropped write to other peers. This is what node.Config.LightMode (see
+// node.WithLightMode) drives.
+func (l *Ledger) SetLightMode(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.light = enabled
+}
+
+// EnableLightMode supplies the ODR client (and a way to list candidate
+// peers) a light Ledger falls back to from GetKey. Called by
+// pkg/blockchain/odr.Mode once it has a host to build the client over.
+func (l *Ledger) EnableLightMode(client ODRClient, peers func() []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.light = true
+	l.odr = client
+	l.odrPeers = peers
+}
+
+// LastBlock returns the most recently mined or appended block.
+func (l *Ledger) LastBlock() *Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.blocks[len(l.blocks)-1]
+}
+
+// BlockAt returns the block at height h, or nil if the ledger hasn't
+// reached (or has rolled back past) it.
+func (l *Ledger) BlockAt(h uint64) *Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if h >= uint64(len(l.blocks)) {
+		return nil
+	}
+	return l.blocks[h]
+}
+
+// AppendBlock accepts block onto the local chain, rejecting it outright if
+// its declared MerkleRoot doesn't match what its own Storage actually
+// hashes to - a peer advertising a root it can't back up is either buggy
+// or lying, and either way its block must not be indexed.
+func (l *Ledger) AppendBlock(block *Block) error {
+	root, err := MerkleRoot(canonicalizeStorage(block.Storage))
+	if err != nil {
+		return err
+	}
+	if string(root) != string(block.MerkleRoot) {
+		return errors.New("blockchain: block failed merkle root verification, refusing to append")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if block.Index != len(l.blocks) {
+		return errors.New("blockchain: non-contiguous block")
+	}
+	l.blocks = append(l.blocks, block)
+	return nil
+}
+
+// RollbackTo discards every block after height, used by
+// pkg/blockchain/sync's fork recovery.
+func (l *Ledger) RollbackTo(height uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if height+1 > uint64(len(l.blocks)) {
+		return errors.New("blockchain: rollback target is ahead of the local chain")
+	}
+	l.blocks = l.blocks[:height+1]
+	return nil
+}
+
+// Add mines data into the current block's bucket and re-stamps the block's
+// MerkleRoot over its new contents, so LastBlock always advertises a root
+// that matches what it actually holds. In light mode Add returns without
+// doing anything: the write is not indexed locally, and the Ledger does not
+// send it to other peers.
+func (l *Ledger) Add(bucket string, data map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.light {
+		return
+	}
+
+	current := l.blocks[len(l.blocks)-1]
+	if current.Storage[bucket] == nil {
+		current.Storage[bucket] = map[string]Data{}
+	}
+	for key, v := range data {
+		encoded, err := newData(v)
+		if err != nil {
+			continue
+		}
+		current.Storage[bucket][key] = encoded
+	}
+
+	if root, err := MerkleRoot(canonicalizeStorage(current.Storage)); err == nil {
+		current.MerkleRoot = root
+	}
+}
+
+// DeleteBucket drops every entry of bucket from the current block and
+// re-stamps its MerkleRoot, same as Add.
+func (l *Ledger) DeleteBucket(bucket string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := l.blocks[len(l.blocks)-1]
+	delete(current.Storage, bucket)
+
+	if root, err := MerkleRoot(canonicalizeStorage(current.Storage)); err == nil {
+		current.MerkleRoot = root
+	}
+}
+
+// GetKey returns bucket/key's current value. In light mode, once
+// EnableLightMode has supplied an ODR client, this transparently fetches
+// (and short-TTL caches) it from a peer instead of reading local storage.
+func (l *Ledger) GetKey(bucket, key string) (Data, bool) {
+	l.mu.RLock()
+	light, odr := l.light, l.odr
+	if !light || odr == nil {
+		current := l.blocks[len(l.blocks)-1]
+		data, found := current.Storage[bucket][key]
+		l.mu.RUnlock()
+		return data, found
+	}
+	l.mu.RUnlock()
+
+	return l.odrGetKey(bucket, key)
+}
+
+func (l *Ledger) odrGetKey(bucket, key string) (Data, bool) {
+	cacheKey := bucket + "/" + key
+
+	l.mu.RLock()
+	entry, ok := l.cache[cacheKey]
+	l.mu.RUnlock()
+	if ok && time.Since(entry.fetchedAt) < odrCacheTTL {
+		return entry.value, true
+	}
+
+	l.mu.RLock()
+	peers, odr := l.odrPeers, l.odr
+	l.mu.RUnlock()
+	if peers == nil || odr == nil {
+		return nil, false
+	}
+	candidates := peers()
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	value, err := odr.GetValue(candidates[rand.Intn(len(candidates))], bucket, key)
+	if err != nil {
+		return nil, false
+	}
+
+	l.mu.Lock()
+	l.cache[cacheKey] = odrCacheEntry{value: Data(value), fetchedAt: time.Now()}
+	l.mu.Unlock()
+	return Data(value), true
+}
+
+// CurrentData returns every bucket/key this Ledger currently knows. In
+// light mode it issues no ODR request of its own: it only reflects entries
+// individually fetched (and not yet expired) via GetKey - a light node
+// never holds the whole ledger at once.
+func (l *Ledger) CurrentData() map[string]map[string]Data {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.light {
+		out := map[string]map[string]Data{}
+		for cacheKey, entry := range l.cache {
+			if time.Since(entry.fetchedAt) >= odrCacheTTL {
+				continue
+			}
+			bucket, key, ok := splitCacheKey(cacheKey)
+			if !ok {
+				continue
+			}
+			if out[bucket] == nil {
+				out[bucket] = map[string]Data{}
+			}
+			out[bucket][key] = entry.value
+		}
+		return out
+	}
+
+	current := l.blocks[len(l.blocks)-1]
+	out := make(map[string]map[string]Data, len(current.Storage))
+	for bucket, entries := range current.Storage {
+		copied := make(map[string]Data, len(entries))
+		for key, value := range entries {
+			copied[key] = value
+		}
+		out[bucket] = copied
+	}
+	return out
+}
+
+// Announce runs fn immediately and then every interval until ctx is
+// canceled, the announce-loop shape every ExposeService/ConnectToService/
+// Alive caller already expects.
+func (l *Ledger) Announce(ctx context.Context, interval time.Duration, fn func()) {
+	go func() {
+		fn()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// canonicalizeStorage flattens a nested bucket map into bucket/key -> raw
+// bytes, the leaf layout MerkleRoot expects.
+func canonicalizeStorage(storage map[string]map[string]Data) map[string][]byte {
+	flat := map[string][]byte{}
+	for bucket, entries := range storage {
+		for key, data := range entries {
+			flat[bucket+"/"+key] = data.Bytes()
+		}
+	}
+	return flat
+}
+
+// splitCacheKey reverses the bucket+"/"+key join odrGetKey's cache uses.
+func splitCacheKey(cacheKey string) (bucket, key string, ok bool) {
+	idx := strings.Index(cacheKey, "/")
+	if idx < 0 {
+		return "", "", false
+	}
+	return cacheKey[:idx], cacheKey[idx+1:], true
+}
@@ -0,0 +1,143 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package light lets memory-constrained nodes keep only block headers
+// locally instead of replicating the whole ledger, fetching bucket values
+// on demand from full peers via the ledger ODR protocol (pkg/blockchain/odr).
+package light
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Header is everything a light node keeps for a block: enough to verify the
+// chain links up and to check ODR proofs against, without the block's full
+// bucket contents.
+type Header struct {
+	Height     uint64
+	PrevHash   string
+	MerkleRoot []byte
+	Timestamp  time.Time
+	Signer     string
+	Signature  []byte
+}
+
+// Store keeps the header chain a light node has verified so far.
+type Store struct {
+	mu      sync.RWMutex
+	headers map[uint64]Header
+	latest  uint64
+}
+
+// NewStore creates an empty header store.
+func NewStore() *Store {
+	return &Store{headers: map[uint64]Header{}}
+}
+
+// Append verifies h links onto the current head (by height and PrevHash)
+// and that h.Signature verifies against h.Signer before accepting it, so a
+// sync peer can't forge a header's MerkleRoot without the signer's private
+// key.
+func (s *Store) Append(h Header) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, hasHead := s.headers[s.latest]
+	if hasHead {
+		if h.Height != head.Height+1 {
+			return errors.New("light: non-contiguous header")
+		}
+		if h.PrevHash != headerHash(head) {
+			return errors.New("light: header does not chain onto the current head")
+		}
+	} else if h.Height != 0 {
+		return errors.New("light: expected genesis header first")
+	}
+
+	if err := verifyHeaderSignature(h); err != nil {
+		return err
+	}
+
+	s.headers[h.Height] = h
+	if h.Height > s.latest || len(s.headers) == 1 {
+		s.latest = h.Height
+	}
+	return nil
+}
+
+// headerSigningBytes returns the canonical bytes a header's signer signs
+// (and a verifier re-derives): every field except the signature itself.
+func headerSigningBytes(h Header) []byte {
+	buf := make([]byte, 0, 24+len(h.PrevHash)+len(h.MerkleRoot)+len(h.Signer))
+	var height, ts [8]byte
+	binary.BigEndian.PutUint64(height[:], h.Height)
+	binary.BigEndian.PutUint64(ts[:], uint64(h.Timestamp.UnixNano()))
+	buf = append(buf, height[:]...)
+	buf = append(buf, []byte(h.PrevHash)...)
+	buf = append(buf, h.MerkleRoot...)
+	buf = append(buf, ts[:]...)
+	buf = append(buf, []byte(h.Signer)...)
+	return buf
+}
+
+// headerHash is what the next header's PrevHash links to.
+func headerHash(h Header) string {
+	sum := sha256.Sum256(headerSigningBytes(h))
+	return fmt.Sprintf("%x", sum)
+}
+
+// verifyHeaderSignature checks h.Signature against h.Signer's libp2p public
+// key, which is recoverable straight from the peer ID itself.
+func verifyHeaderSignature(h Header) error {
+	signer, err := peer.Decode(h.Signer)
+	if err != nil {
+		return fmt.Errorf("light: invalid signer: %w", err)
+	}
+	pub, err := signer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("light: could not recover signer's public key: %w", err)
+	}
+	ok, err := pub.Verify(headerSigningBytes(h), h.Signature)
+	if err != nil {
+		return fmt.Errorf("light: signature verification error: %w", err)
+	}
+	if !ok {
+		return errors.New("light: header signature does not verify against signer")
+	}
+	return nil
+}
+
+// Head returns the most recent header this store has verified.
+func (s *Store) Head() (Header, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.headers[s.latest]
+	return h, ok
+}
+
+// At returns the header at a given height, if known.
+func (s *Store) At(height uint64) (Header, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.headers[height]
+	return h, ok
+}
@@ -0,0 +1,47 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"context"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+)
+
+// Mode wires up light (header-only) operation as a node.NetworkService: it
+// runs the header SyncManager for the node's lifetime, so the node joins
+// quickly and stays small instead of replicating the whole ledger. Pair it
+// with node.WithLightMode() so ExposeService/ConnectToService/Alive keep
+// working unchanged - they only ever touch Ledger.GetKey/Add/Announce.
+func Mode(store *Store, pollInterval time.Duration) []node.Option {
+	return []node.Option{
+		node.WithNetworkService(
+			func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+				mgr := NewSyncManager(n.Host(), b, store, pollInterval)
+				if err := mgr.Start(ctx); err != nil {
+					return err
+				}
+				go func() {
+					<-ctx.Done()
+					mgr.Stop()
+				}()
+				return nil
+			},
+		),
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	gorpc "github.com/libp2p/go-libp2p-gorpc"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+)
+
+// headerRPCService serves HeaderSyncProtocol requests out of a full node's
+// ledger, projecting each blockchain.Block down to its Header.
+type headerRPCService struct {
+	ledger *blockchain.Ledger
+}
+
+func (s *headerRPCService) GetHeaders(ctx context.Context, req HeaderRangeRequest, resp *HeaderRangeResponse) error {
+	for h := req.From; h < req.To; h++ {
+		block := s.ledger.BlockAt(h)
+		if block == nil {
+			break
+		}
+		resp.Headers = append(resp.Headers, Header{
+			Height:     uint64(block.Index),
+			PrevHash:   block.PrevHash,
+			MerkleRoot: block.MerkleRoot,
+			Timestamp:  time.Unix(block.Timestamp, 0),
+			Signer:     block.Validator,
+			Signature:  block.Signature,
+		})
+	}
+	return nil
+}
+
+// ServeHeaders registers a headerRPCService for ledger on h, so light peers
+// can catch up their Store via a SyncManager.
+func ServeHeaders(h host.Host, ledger *blockchain.Ledger) (*gorpc.Server, error) {
+	server := gorpc.NewServer(h, HeaderSyncProtocol)
+	if err := server.RegisterName("headersync", &headerRPCService{ledger: ledger}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,139 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	gorpc "github.com/libp2p/go-libp2p-gorpc"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/services"
+)
+
+// HeaderSyncProtocol carries header-only catch-up traffic for light nodes,
+// analogous to pkg/blockchain/sync's full-block LedgerSyncProtocol.
+const HeaderSyncProtocol = "/edgevpn/ledger-header-sync/1.0.0"
+
+// HeaderRangeRequest asks for the half-open range [From, To) of headers.
+type HeaderRangeRequest struct {
+	From, To uint64
+}
+
+// HeaderRangeResponse carries the requested headers, in order.
+type HeaderRangeResponse struct {
+	Headers []Header
+}
+
+// SyncManager keeps a light node's Store caught up by pulling header ranges
+// from a bootstrap peer, analogous to pkg/blockchain/sync.SyncManager but
+// for headers only.
+type SyncManager struct {
+	ledger    *blockchain.Ledger
+	store     *Store
+	rpcClient *gorpc.Client
+
+	pollInterval time.Duration
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+}
+
+// NewSyncManager creates a SyncManager that keeps store caught up with
+// ledger's header chain, polling every pollInterval.
+func NewSyncManager(h host.Host, ledger *blockchain.Ledger, store *Store, pollInterval time.Duration) *SyncManager {
+	return &SyncManager{
+		ledger:       ledger,
+		store:        store,
+		rpcClient:    gorpc.NewClient(h, HeaderSyncProtocol),
+		pollInterval: pollInterval,
+	}
+}
+
+// Start performs an initial header catch-up from a bootstrap peer, then
+// keeps polling for new headers until ctx is canceled.
+func (s *SyncManager) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	if bootstrap := s.pickBootstrapPeer(); bootstrap != "" {
+		_ = s.catchUpFrom(ctx, bootstrap)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(s.pollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if bootstrap := s.pickBootstrapPeer(); bootstrap != "" {
+					_ = s.catchUpFrom(ctx, bootstrap)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop halts the background header poller.
+func (s *SyncManager) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+func (s *SyncManager) pickBootstrapPeer() string {
+	nodes := services.AvailableNodes(s.ledger)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[rand.Intn(len(nodes))]
+}
+
+func (s *SyncManager) catchUpFrom(ctx context.Context, peerID string) error {
+	d, err := peer.Decode(peerID)
+	if err != nil {
+		return err
+	}
+
+	from := uint64(0)
+	if head, ok := s.store.Head(); ok {
+		from = head.Height + 1
+	}
+
+	var resp HeaderRangeResponse
+	req := HeaderRangeRequest{From: from, To: from + 1024}
+	if err := s.rpcClient.Call(d, "headersync", "GetHeaders", req, &resp); err != nil {
+		return err
+	}
+
+	for _, h := range resp.Headers {
+		if err := s.store.Append(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
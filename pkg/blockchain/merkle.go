@@ -0,0 +1,79 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"sort"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/keccak256"
+)
+
+// merkleLeaf returns the canonical leaf for a ledger bucket entry: the
+// bucket key followed by the sha256 of its canonical (marshalled) value.
+// Sorting leaves by key before building the tree makes the root independent
+// of map iteration order.
+func merkleLeaf(bucketKey string, bucketValue []byte) []byte {
+	sum := sha256.Sum256(bucketValue)
+	return append([]byte(bucketKey), sum[:]...)
+}
+
+// MerkleRoot computes the Merkle root over a bucket's entries, keyed by
+// bucket key and holding the entry's canonical encoded bytes. It is used
+// both to stamp a newly mined Block and, on the receiving side, to verify
+// that a synced block's contents match the root it was advertised with.
+func MerkleRoot(entries map[string][]byte) ([]byte, error) {
+	tree, err := newMerkleTree(entries)
+	if err != nil {
+		return nil, err
+	}
+	return tree.Root(), nil
+}
+
+// MerkleProof returns an inclusion proof for bucketKey within entries, so a
+// light node can verify a single key without fetching the whole bucket.
+func MerkleProof(entries map[string][]byte, bucketKey string) (*merkletree.Proof, error) {
+	tree, err := newMerkleTree(entries)
+	if err != nil {
+		return nil, err
+	}
+	return tree.GenerateProof(merkleLeaf(bucketKey, entries[bucketKey]), 0)
+}
+
+// VerifyMerkleProof checks that bucketKey/bucketValue is included in the
+// tree committed to by root.
+func VerifyMerkleProof(root []byte, bucketKey string, bucketValue []byte, proof *merkletree.Proof) (bool, error) {
+	return merkletree.VerifyProofUsing(merkleLeaf(bucketKey, bucketValue), false, proof, [][]byte{root}, keccak256.New())
+}
+
+func newMerkleTree(entries map[string][]byte) (*merkletree.MerkleTree, error) {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	leaves := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		leaves = append(leaves, merkleLeaf(k, entries[k]))
+	}
+	if len(leaves) == 0 {
+		leaves = [][]byte{{}}
+	}
+
+	return merkletree.NewUsing(leaves, keccak256.New(), nil)
+}
@@ -0,0 +1,103 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package blockchain
+
+import "testing"
+
+func TestMerkleRootIndependentOfMapOrder(t *testing.T) {
+	a := map[string][]byte{"services/a": []byte("1"), "services/b": []byte("2"), "users/c": []byte("3")}
+	b := map[string][]byte{"users/c": []byte("3"), "services/a": []byte("1"), "services/b": []byte("2")}
+
+	rootA, err := MerkleRoot(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootB, err := MerkleRoot(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rootA) != string(rootB) {
+		t.Fatal("root should not depend on map iteration order")
+	}
+}
+
+// TestMerkleProofRoundTrip is the round-trip this package depends on: a
+// proof generated over the whole entry set for any key must verify against
+// that same set's root, the way pkg/blockchain/sync and pkg/blockchain/odr
+// both rely on.
+func TestMerkleProofRoundTrip(t *testing.T) {
+	entries := map[string][]byte{
+		"services/svc-a": []byte("provider-a"),
+		"services/svc-b": []byte("provider-b"),
+		"users/peer-1":   []byte("user-1"),
+	}
+
+	root, err := MerkleRoot(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range entries {
+		proof, err := MerkleProof(entries, key)
+		if err != nil {
+			t.Fatalf("MerkleProof(%s): %s", key, err)
+		}
+		ok, err := VerifyMerkleProof(root, key, value, proof)
+		if err != nil {
+			t.Fatalf("VerifyMerkleProof(%s): %s", key, err)
+		}
+		if !ok {
+			t.Fatalf("proof for %s did not verify against the whole-set root", key)
+		}
+	}
+}
+
+func TestMerkleProofFailsAgainstTamperedValue(t *testing.T) {
+	entries := map[string][]byte{"services/svc-a": []byte("provider-a")}
+	root, err := MerkleRoot(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := MerkleProof(entries, "services/svc-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyMerkleProof(root, "services/svc-a", []byte("tampered"), proof); ok {
+		t.Fatal("proof verified against a tampered value")
+	}
+}
+
+func TestMerkleProofFailsAgainstDifferentSubsetRoot(t *testing.T) {
+	whole := map[string][]byte{
+		"services/svc-a": []byte("provider-a"),
+		"services/svc-b": []byte("provider-b"),
+	}
+	subset := map[string][]byte{"services/svc-a": whole["services/svc-a"]}
+
+	wholeRoot, err := MerkleRoot(whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A proof built from a subset of the entries (e.g. a single bucket) must
+	// not verify against the root committed to by the whole set.
+	subsetProof, err := MerkleProof(subset, "services/svc-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyMerkleProof(wholeRoot, "services/svc-a", whole["services/svc-a"], subsetProof); ok {
+		t.Fatal("a subset-built proof verified against the whole-set root")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package odr implements the ledger's on-demand-retrieval protocol: a light
+// node that only keeps block headers (pkg/blockchain/light) can fetch a
+// single bucket value, or a whole bucket, from a full peer and verify it
+// against the Merkle root in a header it already trusts.
+//
+// Client is the piece a light Ledger.GetKey (pkg/blockchain) falls back to
+// when light mode is enabled - see Mode, which wires a Client into the
+// Ledger as a node.NetworkService. Ledger.CurrentData does not use it.
+package odr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	gorpc "github.com/libp2p/go-libp2p-gorpc"
+	merkletree "github.com/wealdtech/go-merkletree"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/blockchain/light"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/services"
+)
+
+// Protocol carries ODR requests between a light node and a full peer.
+const Protocol = "/edgevpn/ledger-odr/1.0.0"
+
+// cacheTTL bounds how long a light node trusts a previously fetched value
+// before re-fetching and re-verifying it.
+const cacheTTL = 10 * time.Second
+
+// GetValueRequest asks for a single bucket entry at a given height.
+type GetValueRequest struct {
+	Height    uint64
+	Bucket    string
+	BucketKey string
+}
+
+// GetValueResponse carries the value and its Merkle inclusion proof.
+type GetValueResponse struct {
+	Value []byte
+	Proof []byte
+}
+
+// GetBucketRequest asks for every entry of a bucket at a given height.
+type GetBucketRequest struct {
+	Height uint64
+	Bucket string
+}
+
+// GetBucketResponse carries every entry of the bucket and a proof per key.
+type GetBucketResponse struct {
+	Values map[string][]byte
+	Proofs map[string][]byte
+}
+
+// rpcService serves ODR requests out of a full node's ledger.
+type rpcService struct {
+	ledger *blockchain.Ledger
+}
+
+func (s *rpcService) GetValue(ctx context.Context, req GetValueRequest, resp *GetValueResponse) error {
+	block := s.ledger.BlockAt(req.Height)
+	if block == nil {
+		return errors.New("odr: unknown height")
+	}
+	// The proof must be built from the same whole-block leaf set the
+	// header's MerkleRoot was stamped over, not just the requested bucket,
+	// or it can never verify against that root.
+	entries := flattenBlock(block.Storage)
+	leafKey := req.Bucket + "/" + req.BucketKey
+	proof, err := blockchain.MerkleProof(entries, leafKey)
+	if err != nil {
+		return err
+	}
+	marshalled, err := proof.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	resp.Value = entries[leafKey]
+	resp.Proof = marshalled
+	return nil
+}
+
+func (s *rpcService) GetBucket(ctx context.Context, req GetBucketRequest, resp *GetBucketResponse) error {
+	block := s.ledger.BlockAt(req.Height)
+	if block == nil {
+		return errors.New("odr: unknown height")
+	}
+	entries := flattenBlock(block.Storage)
+	prefix := req.Bucket + "/"
+
+	resp.Values = map[string][]byte{}
+	resp.Proofs = map[string][]byte{}
+	for leafKey, value := range entries {
+		if !strings.HasPrefix(leafKey, prefix) {
+			continue
+		}
+		proof, err := blockchain.MerkleProof(entries, leafKey)
+		if err != nil {
+			return err
+		}
+		marshalled, err := proof.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(leafKey, prefix)
+		resp.Values[key] = value
+		resp.Proofs[key] = marshalled
+	}
+	return nil
+}
+
+// flattenBlock flattens every bucket of a block's storage into
+// bucket/key -> raw bytes, matching the whole-block leaf set the header's
+// MerkleRoot is computed over (see pkg/blockchain/sync's canonicalize).
+func flattenBlock(storage map[string]map[string]blockchain.Data) map[string][]byte {
+	flat := map[string][]byte{}
+	for bucket, entries := range storage {
+		for key, data := range entries {
+			flat[bucket+"/"+key] = data.Bytes()
+		}
+	}
+	return flat
+}
+
+// Serve registers an ODR rpcService for ledger on h, so light peers can
+// fetch bucket contents from this (full) node.
+func Serve(h host.Host, ledger *blockchain.Ledger) (*gorpc.Server, error) {
+	server := gorpc.NewServer(h, Protocol)
+	if err := server.RegisterName("odr", &rpcService{ledger: ledger}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// cacheEntry is a previously fetched-and-verified value, kept around for
+// cacheTTL so repeated light-mode reads don't all hit the network.
+type cacheEntry struct {
+	value     []byte
+	fetchedAt time.Time
+}
+
+// Client fetches bucket values on demand from full peers, verifying every
+// response against a light.Store header before trusting it.
+type Client struct {
+	rpcClient *gorpc.Client
+	store     *light.Store
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// NewClient creates an ODR Client that verifies fetched values against
+// headers in store.
+func NewClient(h host.Host, store *light.Store) *Client {
+	return &Client{
+		rpcClient: gorpc.NewClient(h, Protocol),
+		store:     store,
+		cache:     map[string]cacheEntry{},
+	}
+}
+
+// GetValue fetches bucket/bucketKey from peerID, verifying it against the
+// locally stored header's Merkle root, and caches the result for cacheTTL.
+func (c *Client) GetValue(peerID, bucket, bucketKey string) ([]byte, error) {
+	cacheKey := peerID + "/" + bucket + "/" + bucketKey
+	c.mu.Lock()
+	entry, ok := c.cache[cacheKey]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < cacheTTL {
+		return entry.value, nil
+	}
+
+	head, ok := c.store.Head()
+	if !ok {
+		return nil, errors.New("odr: no verified header to check the proof against")
+	}
+
+	d, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp GetValueResponse
+	req := GetValueRequest{Height: head.Height, Bucket: bucket, BucketKey: bucketKey}
+	if err := c.rpcClient.Call(d, "odr", "GetValue", req, &resp); err != nil {
+		return nil, err
+	}
+
+	proof := &merkletree.Proof{}
+	if err := proof.UnmarshalJSON(resp.Proof); err != nil {
+		return nil, err
+	}
+	verified, err := blockchain.VerifyMerkleProof(head.MerkleRoot, bucket+"/"+bucketKey, resp.Value, proof)
+	if err != nil || !verified {
+		return nil, errors.New("odr: value failed merkle proof verification")
+	}
+
+	c.mu.Lock()
+	c.cache[cacheKey] = cacheEntry{value: resp.Value, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return resp.Value, nil
+}
+
+// GetBucket fetches every entry of bucket from peerID, verifying each one
+// against the locally stored header's Merkle root, and caches every value
+// for cacheTTL just like GetValue.
+func (c *Client) GetBucket(peerID, bucket string) (map[string][]byte, error) {
+	head, ok := c.store.Head()
+	if !ok {
+		return nil, errors.New("odr: no verified header to check the proof against")
+	}
+
+	d, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp GetBucketResponse
+	req := GetBucketRequest{Height: head.Height, Bucket: bucket}
+	if err := c.rpcClient.Call(d, "odr", "GetBucket", req, &resp); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(resp.Values))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, value := range resp.Values {
+		proof := &merkletree.Proof{}
+		if err := proof.UnmarshalJSON(resp.Proofs[key]); err != nil {
+			return nil, err
+		}
+		leafKey := bucket + "/" + key
+		verified, err := blockchain.VerifyMerkleProof(head.MerkleRoot, leafKey, value, proof)
+		if err != nil || !verified {
+			return nil, errors.New("odr: value failed merkle proof verification")
+		}
+
+		c.cache[peerID+"/"+leafKey] = cacheEntry{value: value, fetchedAt: time.Now()}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Mode wires a Client into the node's ledger as a node.NetworkService: once
+// the node finishes starting, Ledger.GetKey transparently falls back to
+// fetching from a peer in services.AvailableNodes and verifying the result
+// against store's header chain, instead of only ever serving from (in light
+// mode, empty) local storage; Ledger.CurrentData still returns only what
+// GetKey has cached. It is a no-op unless the node was
+// also built with node.WithLightMode(); pair it with light.Mode so store
+// itself stays caught up.
+func Mode(store *light.Store) node.Option {
+	return node.WithNetworkService(
+		func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+			if !c.LightMode {
+				return nil
+			}
+			client := NewClient(n.Host(), store)
+			b.EnableLightMode(client, func() []string {
+				return services.AvailableNodes(b)
+			})
+			return nil
+		},
+	)
+}
@@ -0,0 +1,330 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package sync lets a newly joined (or long-partitioned) node catch up with
+// the ledger by pulling block ranges from a bootstrap peer instead of only
+// tailing pubsub, which is both slow and lossy across long partitions.
+//
+// Stamping a mined block's MerkleRoot still belongs to the ledger's own
+// Add/Write path (pkg/blockchain); this package only ever verifies a root it
+// was handed, via verifyBlockRoot and IngestPubsubBlock.
+package sync
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	gorpc "github.com/libp2p/go-libp2p-gorpc"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/services"
+)
+
+// LedgerSyncProtocol is the libp2p protocol ID the sync RPC service is
+// registered under.
+const LedgerSyncProtocol = protocol.ID("/edgevpn/ledger-sync/1.0.0")
+
+// Head describes the tip of a node's chain.
+type Head struct {
+	Height     uint64
+	MerkleRoot []byte
+}
+
+// BlockRangeRequest asks for the half-open range [From, To) of blocks.
+type BlockRangeRequest struct {
+	From, To uint64
+}
+
+// BlockRangeResponse carries the requested blocks, in order.
+type BlockRangeResponse struct {
+	Blocks []*blockchain.Block
+}
+
+// ProofRequest asks for a single bucket entry at a given height, along with
+// a Merkle proof of its inclusion.
+type ProofRequest struct {
+	Height    uint64
+	Bucket    string
+	BucketKey string
+}
+
+// ProofResponse carries the requested value and its inclusion proof.
+type ProofResponse struct {
+	Value []byte
+	Proof []byte
+}
+
+// rpcService is the gorpc-registered object backing LedgerSyncProtocol.
+type rpcService struct {
+	ledger *blockchain.Ledger
+}
+
+func (s *rpcService) GetHead(ctx context.Context, _ struct{}, resp *Head) error {
+	b := s.ledger.LastBlock()
+	root, err := blockchain.MerkleRoot(canonicalize(b.Storage))
+	if err != nil {
+		return err
+	}
+	resp.Height = uint64(b.Index)
+	resp.MerkleRoot = root
+	return nil
+}
+
+func (s *rpcService) GetBlockRange(ctx context.Context, req BlockRangeRequest, resp *BlockRangeResponse) error {
+	if req.To < req.From {
+		return errors.New("invalid range")
+	}
+	for h := req.From; h < req.To; h++ {
+		block := s.ledger.BlockAt(h)
+		if block == nil {
+			break
+		}
+		resp.Blocks = append(resp.Blocks, block)
+	}
+	return nil
+}
+
+func (s *rpcService) GetProof(ctx context.Context, req ProofRequest, resp *ProofResponse) error {
+	block := s.ledger.BlockAt(req.Height)
+	if block == nil {
+		return errors.New("unknown height")
+	}
+	// The proof must be built from the same whole-block leaf set GetHead's
+	// root is computed over - a tree over just the requested bucket commits
+	// to a different root entirely, so its proofs could never verify.
+	entries := canonicalize(block.Storage)
+	leafKey := req.Bucket + "/" + req.BucketKey
+	proof, err := blockchain.MerkleProof(entries, leafKey)
+	if err != nil {
+		return err
+	}
+	resp.Value = entries[leafKey]
+	marshalled, err := proof.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	resp.Proof = marshalled
+	return nil
+}
+
+// canonicalize flattens a nested bucket map into bucket/key -> raw bytes,
+// matching the leaf layout blockchain.MerkleRoot expects.
+func canonicalize(storage map[string]map[string]blockchain.Data) map[string][]byte {
+	flat := map[string][]byte{}
+	for bucket, entries := range storage {
+		for key, data := range entries {
+			flat[bucket+"/"+key] = data.Bytes()
+		}
+	}
+	return flat
+}
+
+// SyncManager drives the initial catch-up of a node's ledger and keeps
+// watching for forks once it is caught up.
+type SyncManager struct {
+	host   host.Host
+	ledger *blockchain.Ledger
+	logger logger.Logger
+
+	rpcClient *gorpc.Client
+	rpcServer *gorpc.Server
+
+	pollInterval  time.Duration
+	syncCompleted uint32
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// New creates a SyncManager for ledger, serving and consuming the ledger
+// sync protocol over h.
+func New(h host.Host, ledger *blockchain.Ledger, l logger.Logger, pollInterval time.Duration) (*SyncManager, error) {
+	server := gorpc.NewServer(h, LedgerSyncProtocol)
+	if err := server.RegisterName("sync", &rpcService{ledger: ledger}); err != nil {
+		return nil, err
+	}
+
+	return &SyncManager{
+		host:         h,
+		ledger:       ledger,
+		logger:       l,
+		rpcClient:    gorpc.NewClient(h, LedgerSyncProtocol),
+		rpcServer:    server,
+		pollInterval: pollInterval,
+	}, nil
+}
+
+// Completed reports whether the initial catch-up has finished. Until it
+// has, IngestPubsubBlock drops late blocks observed over pubsub rather
+// than appending them, so the chain stays contiguous.
+func (s *SyncManager) Completed() bool {
+	return atomic.LoadUint32(&s.syncCompleted) == 1
+}
+
+// IngestPubsubBlock is the gate the ledger's pubsub tail must call instead of
+// appending blocks directly: it drops anything observed before the initial
+// catch-up has finished (Completed), and rejects any block whose recomputed
+// Merkle root disagrees with the one it was advertised with.
+func (s *SyncManager) IngestPubsubBlock(block *blockchain.Block) error {
+	if !s.Completed() {
+		return errors.New("ledger-sync: initial catch-up still in progress, dropping pubsub block")
+	}
+	if err := verifyBlockRoot(block); err != nil {
+		return err
+	}
+	return s.ledger.AppendBlock(block)
+}
+
+// Start picks a bootstrap peer out of the active set, performs an initial
+// catch-up, then keeps polling peers for forks until ctx is canceled.
+func (s *SyncManager) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	bootstrap := s.pickBootstrapPeer()
+	if bootstrap != "" {
+		if err := s.catchUpFrom(ctx, bootstrap); err != nil {
+			s.logger.Warnf("ledger-sync: initial catch-up from %s failed: %s", bootstrap, err.Error())
+		}
+	}
+	atomic.StoreUint32(&s.syncCompleted, 1)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(s.pollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				s.detectAndRecoverForks(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop halts the background fork-detection loop.
+func (s *SyncManager) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+func (s *SyncManager) pickBootstrapPeer() string {
+	nodes := services.AvailableNodes(s.ledger)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[rand.Intn(len(nodes))]
+}
+
+func (s *SyncManager) catchUpFrom(ctx context.Context, peerID string) error {
+	d, err := peer.Decode(peerID)
+	if err != nil {
+		return err
+	}
+
+	var head Head
+	if err := s.rpcClient.Call(d, "sync", "GetHead", struct{}{}, &head); err != nil {
+		return err
+	}
+
+	local := s.ledger.LastBlock()
+	if uint64(local.Index) >= head.Height {
+		return nil
+	}
+
+	var resp BlockRangeResponse
+	req := BlockRangeRequest{From: uint64(local.Index) + 1, To: head.Height + 1}
+	if err := s.rpcClient.Call(d, "sync", "GetBlockRange", req, &resp); err != nil {
+		return err
+	}
+
+	for _, block := range resp.Blocks {
+		if err := verifyBlockRoot(block); err != nil {
+			return err
+		}
+		if err := s.ledger.AppendBlock(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyBlockRoot recomputes block's Merkle root over its whole storage and
+// rejects the block if it disagrees with the root it was advertised with.
+func verifyBlockRoot(block *blockchain.Block) error {
+	root, err := blockchain.MerkleRoot(canonicalize(block.Storage))
+	if err != nil {
+		return err
+	}
+	if string(root) != string(block.MerkleRoot) {
+		return errors.New("block failed merkle root verification")
+	}
+	return nil
+}
+
+// detectAndRecoverForks re-polls GetHead against every peer in
+// AvailableNodes; if more than half of them report a different root at our
+// own height, we roll back our head block (to its parent) and re-sync from
+// there. Only that one block is rolled back: no search for an older common
+// ancestor is made.
+func (s *SyncManager) detectAndRecoverForks(ctx context.Context) {
+	local := s.ledger.LastBlock()
+	ourRoot, err := blockchain.MerkleRoot(canonicalize(local.Storage))
+	if err != nil {
+		return
+	}
+
+	nodes := services.AvailableNodes(s.ledger)
+	mismatches := 0
+	for _, peerID := range nodes {
+		d, err := peer.Decode(peerID)
+		if err != nil {
+			continue
+		}
+		var head Head
+		if err := s.rpcClient.Call(d, "sync", "GetHead", struct{}{}, &head); err != nil {
+			continue
+		}
+		if head.Height == uint64(local.Index) && string(head.MerkleRoot) != string(ourRoot) {
+			mismatches++
+		}
+	}
+
+	if len(nodes) > 0 && mismatches*2 > len(nodes) {
+		s.logger.Warnf("ledger-sync: detected a fork at height %d, rolling back", local.Index)
+		if err := s.ledger.RollbackTo(uint64(local.Index) - 1); err != nil {
+			s.logger.Warnf("ledger-sync: rollback failed: %s", err.Error())
+			return
+		}
+		if bootstrap := s.pickBootstrapPeer(); bootstrap != "" {
+			_ = s.catchUpFrom(ctx, bootstrap)
+		}
+	}
+}
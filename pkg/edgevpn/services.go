@@ -19,6 +19,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
@@ -26,14 +27,97 @@ import (
 	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/edgevpn/types"
+	"github.com/mudler/edgevpn/pkg/services"
 )
 
 const (
 	ServicesLedgerKey = "services"
 	UsersLedgerKey    = "users"
+
+	// servicesLedgerKeySep separates the serviceID from the advertising peer's
+	// ID in a ServicesLedgerKey bucket entry, so several peers can announce
+	// the same serviceID concurrently.
+	servicesLedgerKeySep = "/"
 )
 
-func (e *EdgeVPN) ExposeService(ledger *blockchain.Ledger, serviceID, dstaddress string) {
+// ServiceOption alters how ExposeService/ConnectToService behave.
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	loadBalancer services.LoadBalancer
+	weight       int
+	capacity     int
+	idleTimeout  time.Duration
+}
+
+func newServiceOptions(opts ...ServiceOption) *serviceOptions {
+	o := &serviceOptions{loadBalancer: services.RandomLoadBalancer{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithLoadBalancer sets the strategy used by ConnectToService to pick amongst
+// the peers currently advertising a service. Defaults to RandomLoadBalancer.
+func WithLoadBalancer(lb services.LoadBalancer) ServiceOption {
+	return func(o *serviceOptions) { o.loadBalancer = lb }
+}
+
+// WithWeight sets the weight carried in the announced types.Service, used by
+// weight-aware load balancers on the connecting side.
+func WithWeight(w int) ServiceOption {
+	return func(o *serviceOptions) { o.weight = w }
+}
+
+// WithCapacity sets the capacity carried in the announced types.Service.
+func WithCapacity(c int) ServiceOption {
+	return func(o *serviceOptions) { o.capacity = c }
+}
+
+// WithIdleTimeout sets how long a UDP-backed stream (see ExposeUDPService
+// and ConnectToUDPService) can stay silent before it is reaped. Defaults to
+// defaultUDPIdleTimeout and is ignored by the TCP-backed services.
+func WithIdleTimeout(d time.Duration) ServiceOption {
+	return func(o *serviceOptions) { o.idleTimeout = d }
+}
+
+// serviceProviderKey builds the ServicesLedgerKey bucket entry for a given
+// serviceID/peerID pair.
+func serviceProviderKey(serviceID, peerID string) string {
+	return serviceID + servicesLedgerKeySep + peerID
+}
+
+// serviceProviders returns the known providers of serviceID, keyed by peer ID.
+func serviceProviders(ledger *blockchain.Ledger, serviceID string) map[string]types.Service {
+	providers := map[string]types.Service{}
+	prefix := serviceID + servicesLedgerKeySep
+	for key, data := range ledger.LastBlock().Storage[ServicesLedgerKey] {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		svc := types.Service{}
+		data.Unmarshal(&svc)
+		if svc.Weight > services.MaxProviderWeight {
+			svc.Weight = services.MaxProviderWeight
+		}
+		providers[strings.TrimPrefix(key, prefix)] = svc
+	}
+	return providers
+}
+
+// evictStale drops a LeastLoadedLoadBalancer's bookkeeping for peers that
+// have fallen out of the active set, so a provider that disappears from the
+// healthcheck bucket doesn't leak an inFlight entry forever. Balancers that
+// don't track per-peer state are left untouched.
+func evictStale(lb services.LoadBalancer, active []string) {
+	if e, ok := lb.(interface{ Evict(active []string) }); ok {
+		e.Evict(active)
+	}
+}
+
+func (e *EdgeVPN) ExposeService(ledger *blockchain.Ledger, serviceID, dstaddress string, opts ...ServiceOption) {
+	o := newServiceOptions(opts...)
 
 	e.Logger().Infof("Exposing service '%s' (%s)", serviceID, dstaddress)
 
@@ -43,16 +127,16 @@ func (e *EdgeVPN) ExposeService(ledger *blockchain.Ledger, serviceID, dstaddress
 		context.Background(),
 		e.config.LedgerAnnounceTime,
 		func() {
-			// Retrieve current ID for ip in the blockchain
-			existingValue, found := ledger.GetKey(ServicesLedgerKey, serviceID)
-			service := &types.Service{}
-			existingValue.Unmarshal(service)
-			// If mismatch, update the blockchain
-			if !found || service.PeerID != e.host.ID().String() {
-				updatedMap := map[string]interface{}{}
-				updatedMap[serviceID] = types.Service{PeerID: e.host.ID().String(), Name: serviceID}
-				ledger.Add(ServicesLedgerKey, updatedMap)
+			key := serviceProviderKey(serviceID, e.host.ID().String())
+			updatedMap := map[string]interface{}{}
+			updatedMap[key] = types.Service{
+				PeerID:    e.host.ID().String(),
+				Name:      serviceID,
+				Timestamp: time.Now().Format(time.RFC3339),
+				Weight:    o.weight,
+				Capacity:  o.capacity,
 			}
+			ledger.Add(ServicesLedgerKey, updatedMap)
 		},
 	)
 
@@ -91,7 +175,8 @@ func (e *EdgeVPN) ExposeService(ledger *blockchain.Ledger, serviceID, dstaddress
 	}
 }
 
-func (e *EdgeVPN) ConnectToService(ledger *blockchain.Ledger, serviceID string, srcaddr string) error {
+func (e *EdgeVPN) ConnectToService(ledger *blockchain.Ledger, serviceID string, srcaddr string, opts ...ServiceOption) error {
+	o := newServiceOptions(opts...)
 
 	// Open local port for listening
 	l, err := net.Listen("tcp", srcaddr)
@@ -130,22 +215,35 @@ func (e *EdgeVPN) ConnectToService(ledger *blockchain.Ledger, serviceID string,
 		e.config.Logger.Info("New connection from", l.Addr().String())
 		// Handle connections in a new goroutine, forwarding to the p2p service
 		go func() {
-			// Retrieve current ID for ip in the blockchain
-			existingValue, found := ledger.GetKey(ServicesLedgerKey, serviceID)
-			service := &types.Service{}
-			existingValue.Unmarshal(service)
-			// If mismatch, update the blockchain
+			// Providers currently advertising serviceID, restricted to peers
+			// whose last healthcheck isn't stale.
+			nodes := services.AvailableNodes(ledger)
+			evictStale(o.loadBalancer, nodes)
+
+			active := map[string]struct{}{}
+			for _, p := range nodes {
+				active[p] = struct{}{}
+			}
+			providers := map[string]types.Service{}
+			for peerID, svc := range serviceProviders(ledger, serviceID) {
+				if _, alive := active[peerID]; alive {
+					providers[peerID] = svc
+				}
+			}
+
+			peerID, found := o.loadBalancer.Pick(serviceID, providers)
 			if !found {
 				conn.Close()
-				e.config.Logger.Debugf("service '%s' not found on blockchain", serviceID)
+				e.config.Logger.Debugf("service '%s' has no available provider", serviceID)
 				return
 			}
+			defer o.loadBalancer.Done(serviceID, peerID)
 
 			// Decode the Peer
-			d, err := peer.Decode(service.PeerID)
+			d, err := peer.Decode(peerID)
 			if err != nil {
 				conn.Close()
-				e.config.Logger.Debugf("could not decode peer '%s'", service.PeerID)
+				e.config.Logger.Debugf("could not decode peer '%s'", peerID)
 				return
 			}
 
@@ -156,7 +254,7 @@ func (e *EdgeVPN) ConnectToService(ledger *blockchain.Ledger, serviceID string,
 				e.config.Logger.Debugf("could not open stream '%s'", err.Error())
 				return
 			}
-			e.config.Logger.Debugf("(service %s) Redirecting", serviceID, l.Addr().String())
+			e.config.Logger.Debugf("(service %s) Redirecting to '%s'", serviceID, peerID)
 
 			closer := make(chan struct{}, 2)
 			go copyStream(closer, stream, conn)
@@ -0,0 +1,344 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package edgevpn
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/edgevpn/types"
+	"github.com/mudler/edgevpn/pkg/services"
+)
+
+// ServiceUDPProtocol carries datagram-oriented services (DNS, WireGuard
+// control planes, game servers, QUIC, ...), one libp2p stream per observed
+// client address, framed so packet boundaries survive the stream.
+const ServiceUDPProtocol = protocol.ID("/edgevpn/service-udp/1.0.0")
+
+// defaultUDPIdleTimeout closes a UDP-backed stream whose flow has been
+// silent for this long, if the service didn't request a different one via
+// WithIdleTimeout.
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// writeFramed writes payload to w prefixed with its 2-byte big-endian
+// length, so datagram boundaries survive being carried over a byte stream.
+func writeFramed(w io.Writer, payload []byte) error {
+	var prefix [2]byte
+	binary.BigEndian.PutUint16(prefix[:], uint16(len(payload)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFramed reads one length-prefixed datagram from r.
+func readFramed(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ExposeUDPService is the UDP counterpart of ExposeService: it dials
+// dstaddress over UDP once per inbound stream and shuttles length-prefixed
+// datagrams between the stream and that UDP flow.
+func (e *EdgeVPN) ExposeUDPService(ledger *blockchain.Ledger, serviceID, dstaddress string, opts ...ServiceOption) {
+	o := newServiceOptions(opts...)
+
+	e.Logger().Infof("Exposing UDP service '%s' (%s)", serviceID, dstaddress)
+
+	ledger.Announce(
+		context.Background(),
+		e.config.LedgerAnnounceTime,
+		func() {
+			key := serviceProviderKey(serviceID, e.host.ID().String())
+			ledger.Add(ServicesLedgerKey, map[string]interface{}{
+				key: types.Service{
+					PeerID:    e.host.ID().String(),
+					Name:      serviceID,
+					Timestamp: time.Now().Format(time.RFC3339),
+					Weight:    o.weight,
+					Capacity:  o.capacity,
+				},
+			})
+		},
+	)
+
+	e.config.StreamHandlers[ServiceUDPProtocol] = func(stream network.Stream) {
+		go func() {
+			e.config.Logger.Infof("(udp service %s) Received connection from %s", serviceID, stream.Conn().RemotePeer().String())
+
+			_, found := ledger.GetKey(UsersLedgerKey, stream.Conn().RemotePeer().String())
+			if !found {
+				e.config.Logger.Debugf("Reset '%s': not found in the ledger", stream.Conn().RemotePeer().String())
+				stream.Reset()
+				return
+			}
+
+			c, err := net.Dial("udp", dstaddress)
+			if err != nil {
+				e.config.Logger.Debugf("Reset %s: %s", stream.Conn().RemotePeer().String(), err.Error())
+				stream.Reset()
+				return
+			}
+
+			relayUDPStream(stream, c, o.idleTimeout)
+
+			stream.Close()
+			c.Close()
+			e.config.Logger.Infof("(udp service %s) Handled correctly '%s'", serviceID, stream.Conn().RemotePeer().String())
+		}()
+	}
+}
+
+// ConnectToUDPService is the UDP counterpart of ConnectToService: it opens a
+// local UDP socket and multiplexes each observed client address onto its
+// own libp2p stream to a provider of serviceID.
+func (e *EdgeVPN) ConnectToUDPService(ledger *blockchain.Ledger, serviceID, srcaddr string, opts ...ServiceOption) error {
+	o := newServiceOptions(opts...)
+
+	pc, err := net.ListenPacket("udp", srcaddr)
+	if err != nil {
+		return err
+	}
+	e.Logger().Info("Binding local UDP port on", srcaddr)
+
+	ledger.Announce(
+		context.Background(),
+		e.config.LedgerAnnounceTime,
+		func() {
+			_, found := ledger.GetKey(UsersLedgerKey, e.host.ID().String())
+			if !found {
+				ledger.Add(UsersLedgerKey, map[string]interface{}{
+					e.host.ID().String(): &types.User{
+						PeerID:    e.host.ID().String(),
+						Timestamp: time.Now().String(),
+					},
+				})
+			}
+		},
+	)
+
+	var mu sync.Mutex
+	flows := map[string]*udpFlow{}
+
+	go func() {
+		defer pc.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				e.config.Logger.Error("Error reading UDP packet: ", err.Error())
+				return
+			}
+
+			mu.Lock()
+			flow, ok := flows[addr.String()]
+			mu.Unlock()
+			if !ok {
+				stream, peerID, err := e.openUDPFlow(ledger, serviceID, o)
+				if err != nil {
+					e.config.Logger.Debugf("(udp service %s) could not open stream: %s", serviceID, err.Error())
+					continue
+				}
+
+				flow = &udpFlow{stream: stream, peerID: peerID, activity: make(chan struct{}, 1)}
+				mu.Lock()
+				flows[addr.String()] = flow
+				mu.Unlock()
+
+				go func(clientAddr net.Addr, flow *udpFlow) {
+					relayUDPFlowReplies(pc, clientAddr, flow.stream, flow.activity, o.idleTimeout)
+
+					mu.Lock()
+					delete(flows, clientAddr.String())
+					mu.Unlock()
+					o.loadBalancer.Done(serviceID, flow.peerID)
+					flow.stream.Close()
+				}(addr, flow)
+			}
+
+			if err := writeFramed(flow.stream, buf[:n]); err != nil {
+				e.config.Logger.Debugf("(udp service %s) write failed: %s", serviceID, err.Error())
+				continue
+			}
+			notify(flow.activity)
+		}
+	}()
+
+	return nil
+}
+
+// udpFlow is the per-client-address state ConnectToUDPService multiplexes
+// onto a single libp2p stream: the stream itself, the provider it was opened
+// against (so LoadBalancer.Done is told who to credit back on teardown), and
+// the activity channel shared with relayUDPFlowReplies so traffic in either
+// direction resets the idle timer.
+type udpFlow struct {
+	stream   network.Stream
+	peerID   string
+	activity chan struct{}
+}
+
+// openUDPFlow picks a provider of serviceID via the configured load balancer
+// and opens a fresh ServiceUDPProtocol stream to it.
+func (e *EdgeVPN) openUDPFlow(ledger *blockchain.Ledger, serviceID string, o *serviceOptions) (network.Stream, string, error) {
+	nodes := services.AvailableNodes(ledger)
+	evictStale(o.loadBalancer, nodes)
+
+	active := map[string]struct{}{}
+	for _, p := range nodes {
+		active[p] = struct{}{}
+	}
+	providers := map[string]types.Service{}
+	for peerID, svc := range serviceProviders(ledger, serviceID) {
+		if _, alive := active[peerID]; alive {
+			providers[peerID] = svc
+		}
+	}
+
+	peerID, found := o.loadBalancer.Pick(serviceID, providers)
+	if !found {
+		return nil, "", errNoProvider(serviceID)
+	}
+
+	d, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stream, err := e.host.NewStream(context.Background(), d, ServiceUDPProtocol)
+	if err != nil {
+		return nil, "", err
+	}
+	return stream, peerID, nil
+}
+
+// relayUDPStream shuttles framed datagrams between stream and c until
+// either direction fails, or until neither direction has carried a datagram
+// for idleTimeout (or defaultUDPIdleTimeout if unset).
+func relayUDPStream(stream network.Stream, c net.Conn, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	closer := make(chan struct{}, 2)
+	activity := make(chan struct{}, 1)
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				break
+			}
+			if writeFramed(stream, buf[:n]) != nil {
+				break
+			}
+			notify(activity)
+		}
+		closer <- struct{}{}
+	}()
+
+	go func() {
+		for {
+			payload, err := readFramed(stream)
+			if err != nil {
+				break
+			}
+			if _, err := c.Write(payload); err != nil {
+				break
+			}
+			notify(activity)
+		}
+		closer <- struct{}{}
+	}()
+
+	idleReaper(closer, activity, idleTimeout)
+}
+
+// relayUDPFlowReplies reads framed datagrams from stream and writes them
+// back to clientAddr on pc, until idleTimeout passes without any traffic on
+// activity - which the caller also feeds from the client-to-stream
+// direction, so a request-heavy/reply-light flow isn't reaped mid-use.
+func relayUDPFlowReplies(pc net.PacketConn, clientAddr net.Addr, stream network.Stream, activity chan struct{}, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	closer := make(chan struct{}, 1)
+
+	go func() {
+		for {
+			payload, err := readFramed(stream)
+			if err != nil {
+				break
+			}
+			if _, err := pc.WriteTo(payload, clientAddr); err != nil {
+				break
+			}
+			notify(activity)
+		}
+		closer <- struct{}{}
+	}()
+
+	idleReaper(closer, activity, idleTimeout)
+}
+
+// idleReaper waits for closer (the relay goroutines exiting on their own)
+// or for activity to go quiet for idleTimeout, whichever comes first.
+func idleReaper(closer, activity chan struct{}, idleTimeout time.Duration) {
+	t := time.NewTimer(idleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-closer:
+			return
+		case <-activity:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(idleTimeout)
+		case <-t.C:
+			return
+		}
+	}
+}
+
+func notify(activity chan struct{}) {
+	select {
+	case activity <- struct{}{}:
+	default:
+	}
+}
+
+type errNoProvider string
+
+func (e errNoProvider) Error() string {
+	return "service '" + string(e) + "' has no available provider"
+}
@@ -0,0 +1,42 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package types holds the blockchain ledger data structures shared between
+// the edgevpn node and the services built on top of it.
+package types
+
+// Service is a provider of a TCP/UDP service, announced on the blockchain
+// by the peer exposing it. Multiple peers can advertise the same service
+// name concurrently, each under its own PeerID.
+type Service struct {
+	PeerID    string
+	Name      string
+	Timestamp string
+
+	// Weight influences how often this provider is picked relative to others
+	// advertising the same service ID. Zero is treated as the default weight (1).
+	Weight int
+
+	// Capacity caps how many concurrent streams this provider is willing to
+	// accept. Zero means unbounded.
+	Capacity int
+}
+
+// User is a peer that is allowed to connect to services exposed on the
+// blockchain.
+type User struct {
+	PeerID    string
+	Timestamp string
+}
@@ -0,0 +1,30 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+// WithLightMode marks the node as a light client: its Ledger keeps only
+// block headers locally and fetches bucket values on demand over the ledger
+// ODR protocol (pkg/blockchain/odr) instead of replicating every block.
+// Writes (Ledger.Add) are dropped: they are not indexed locally and the
+// Ledger does not send them to other peers. Pair it with
+// pkg/blockchain/light.Mode to run the header
+// sync loop that keeps the local header chain caught up.
+func WithLightMode() Option {
+	return func(c *Config) error {
+		c.LightMode = true
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+// Package node assembles a set of pluggable NetworkServices (healthcheck
+// scrubbing, ledger sync, light-mode header sync, ...) around a shared
+// libp2p host and blockchain.Ledger.
+package node
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/host"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+)
+
+// NetworkService is a pluggable background service started alongside a
+// Node's other services, such as services.Alive's healthcheck announcer or
+// pkg/blockchain/light.Mode's header-sync loop. It runs until ctx is
+// canceled.
+type NetworkService func(ctx context.Context, c Config, n *Node, b *blockchain.Ledger) error
+
+// Config collects the options a Node is constructed with.
+type Config struct {
+	// LightMode marks the node as a light client: see WithLightMode.
+	LightMode bool
+
+	networkServices []NetworkService
+}
+
+// Option configures a Config.
+type Option func(*Config) error
+
+// WithNetworkService registers one or more NetworkServices to run for the
+// lifetime of the Node.
+func WithNetworkService(ns ...NetworkService) Option {
+	return func(c *Config) error {
+		c.networkServices = append(c.networkServices, ns...)
+		return nil
+	}
+}
+
+// Node runs a set of NetworkServices against a shared libp2p host and
+// ledger.
+type Node struct {
+	host   host.Host
+	ledger *blockchain.Ledger
+	config Config
+}
+
+// New creates a Node over h and ledger, applying opts. Options that toggle
+// ledger behavior (e.g. WithLightMode) take effect immediately: a light
+// node's ledger stops indexing writes locally right away, even before
+// Start runs the NetworkServices that actually supply it with an ODR
+// fallback (see pkg/blockchain/odr.Mode).
+func New(h host.Host, ledger *blockchain.Ledger, opts ...Option) (*Node, error) {
+	c := Config{}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
+
+	ledger.SetLightMode(c.LightMode)
+
+	return &Node{host: h, ledger: ledger, config: c}, nil
+}
+
+// Host returns the libp2p host the Node's network services run over.
+func (n *Node) Host() host.Host {
+	return n.host
+}
+
+// Start launches every registered NetworkService. Each is expected to run
+// its own work in the background (e.g. under a goroutine watching ctx) and
+// return once it has started, not once it has finished.
+func (n *Node) Start(ctx context.Context) error {
+	for _, ns := range n.config.networkServices {
+		if err := ns(ctx, n.config, n, n.ledger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
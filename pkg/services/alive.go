@@ -17,8 +17,10 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
 	"time"
 
+	"github.com/mudler/edgevpn/pkg/beacon"
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/mudler/edgevpn/pkg/utils"
@@ -26,43 +28,121 @@ import (
 	"github.com/mudler/edgevpn/pkg/blockchain"
 )
 
-func Alive(announcetime, scrubTime time.Duration) []node.Option {
-	return []node.Option{
-		node.WithNetworkService(
+// AliveOption alters how Alive elects the peer responsible for scrubbing the
+// healthcheck bucket.
+type AliveOption func(*aliveOptions)
+
+type aliveOptions struct {
+	beacon          *beacon.Beacon
+	beaconStaleness time.Duration
+}
+
+// WithBeaconLeaderElection makes Alive derive the scrub leader from b's
+// verifiable randomness instead of the deterministic utils.Leader hash.
+// Every peer computes the leader itself from b's entry for the round, and
+// only the peer that finds itself leader deletes the bucket; a scrub made
+// by another peer is not checked against b. If b hasn't produced a fresh-enough round within staleness, Alive falls
+// back to utils.Leader so the module keeps working offline.
+func WithBeaconLeaderElection(b *beacon.Beacon, staleness time.Duration) AliveOption {
+	return func(o *aliveOptions) {
+		o.beacon = b
+		o.beaconStaleness = staleness
+	}
+}
+
+// scrubLeader picks the peer responsible for scrubbing the healthcheck
+// bucket during the window starting at round. When a beacon is configured
+// and has a recent-enough entry for round, the leader is
+// argmin_i H(drandEntry(round) || peerID_i); otherwise it falls back to the
+// deterministic utils.Leader(nodes).
+func scrubLeader(o *aliveOptions, nodes []string, round uint64) string {
+	if o.beacon != nil && time.Since(o.beacon.LastUpdated()) <= o.beaconStaleness {
+		if entry, err := o.beacon.Entry(round); err == nil {
+			return drandLeader(entry, nodes)
+		}
+	}
+	return utils.Leader(nodes)
+}
+
+func drandLeader(entry []byte, nodes []string) string {
+	var best string
+	var bestHash [sha256.Size]byte
+	first := true
+	for _, peerID := range nodes {
+		h := sha256.Sum256(append(entry, []byte(peerID)...))
+		if first || string(h[:]) < string(bestHash[:]) {
+			best, bestHash, first = peerID, h, false
+		}
+	}
+	return best
+}
+
+func Alive(announcetime, scrubTime time.Duration, opts ...AliveOption) []node.Option {
+	o := &aliveOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	options := []node.Option{}
+	if o.beacon != nil {
+		// Run the beacon under its own lifecycle, attached as a network
+		// service so it starts/stops together with the rest of the node.
+		options = append(options, node.WithNetworkService(
 			func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-				t := time.Now()
-				// By announcing periodically our service to the blockchain
-				b.Announce(
-					ctx,
-					announcetime,
-					func() {
-						// Keep-alive
-						b.Add(protocol.HealthCheckKey, map[string]interface{}{
-							n.Host().ID().String(): time.Now().Format(time.RFC3339),
-						})
-
-						// Keep-alive scrub
-						nodes := AvailableNodes(b)
-						if len(nodes) == 0 {
-							return
-						}
-						lead := utils.Leader(nodes)
-						if !t.Add(scrubTime).After(time.Now()) {
-							// Update timer so not-leader do not attempt to delete bucket afterwards
-							// prevent cycles
-							t = time.Now()
-
-							if lead == n.Host().ID().String() {
-								// Automatically scrub after some time passed
-								b.DeleteBucket(protocol.HealthCheckKey)
-							}
-						}
-					},
-				)
+				if err := o.beacon.Run(ctx); err != nil {
+					return err
+				}
+				go func() {
+					<-ctx.Done()
+					o.beacon.Stop()
+				}()
 				return nil
 			},
-		),
+		))
 	}
+
+	return append(options, node.WithNetworkService(
+		func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+			t := time.Now()
+			// By announcing periodically our service to the blockchain
+			b.Announce(
+				ctx,
+				announcetime,
+				func() {
+					// Keep-alive
+					b.Add(protocol.HealthCheckKey, map[string]interface{}{
+						n.Host().ID().String(): time.Now().Format(time.RFC3339),
+					})
+
+					// Keep-alive scrub
+					nodes := AvailableNodes(b)
+					if len(nodes) == 0 {
+						return
+					}
+					// Divide in nanoseconds rather than scrubTime.Seconds() truncated
+					// to an int64, which is 0 (and panics) for any scrubTime under a
+					// second.
+					interval := scrubTime.Nanoseconds()
+					if interval <= 0 {
+						interval = int64(time.Second)
+					}
+					round := uint64(time.Now().UnixNano() / interval)
+					lead := scrubLeader(o, nodes, round)
+					if !t.Add(scrubTime).After(time.Now()) {
+						// Update timer so not-leader do not attempt to delete bucket afterwards
+						// prevent cycles
+						t = time.Now()
+
+						if lead == n.Host().ID().String() {
+							// Automatically scrub after some time passed
+							b.DeleteBucket(protocol.HealthCheckKey)
+						}
+					}
+				},
+			)
+			return nil
+		},
+	))
 }
 
 func AvailableNodes(b *blockchain.Ledger) (active []string) {
@@ -76,4 +156,4 @@ func AvailableNodes(b *blockchain.Ledger) (active []string) {
 	}
 
 	return active
-}
\ No newline at end of file
+}
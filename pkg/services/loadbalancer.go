@@ -0,0 +1,161 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/mudler/edgevpn/pkg/edgevpn/types"
+)
+
+// LoadBalancer picks a provider peer for a service out of the set of peers
+// currently advertising it, and is notified when a picked peer is done
+// serving a request so it can keep its internal bookkeeping accurate.
+type LoadBalancer interface {
+	// Pick returns the peer ID to use amongst the given providers, or false
+	// if none of them are eligible.
+	Pick(serviceID string, providers map[string]types.Service) (string, bool)
+	// Done is called when a stream handed out by Pick() is closed.
+	Done(serviceID, peerID string)
+}
+
+// MaxProviderWeight bounds how much a single types.Service.Weight can
+// influence picking. Weight is gossiped ledger data any peer can set
+// arbitrarily via its own ExposeService/ExposeUDPService announce, so
+// callers that ingest it (e.g. the ConnectToService/ConnectToUDPService
+// provider pool) must clamp to this before using it for anything
+// allocation-sized, such as RandomLoadBalancer's weighted pool.
+const MaxProviderWeight = 1000
+
+// RandomLoadBalancer picks a provider uniformly at random, weighted by
+// types.Service.Weight (a provider with weight N is N times as likely to be
+// picked as one with weight 1, up to MaxProviderWeight).
+type RandomLoadBalancer struct{}
+
+func (RandomLoadBalancer) Pick(serviceID string, providers map[string]types.Service) (string, bool) {
+	var pool []string
+	for peerID, svc := range providers {
+		w := svc.Weight
+		if w <= 0 {
+			w = 1
+		}
+		if w > MaxProviderWeight {
+			w = MaxProviderWeight
+		}
+		for i := 0; i < w; i++ {
+			pool = append(pool, peerID)
+		}
+	}
+	if len(pool) == 0 {
+		return "", false
+	}
+	return pool[rand.Intn(len(pool))], true
+}
+
+func (RandomLoadBalancer) Done(serviceID, peerID string) {}
+
+// RoundRobinLoadBalancer cycles through the known providers of a service in
+// a stable order, one per call.
+type RoundRobinLoadBalancer struct {
+	mu      sync.Mutex
+	cursors map[string]int
+}
+
+func NewRoundRobinLoadBalancer() *RoundRobinLoadBalancer {
+	return &RoundRobinLoadBalancer{cursors: map[string]int{}}
+}
+
+func (r *RoundRobinLoadBalancer) Pick(serviceID string, providers map[string]types.Service) (string, bool) {
+	if len(providers) == 0 {
+		return "", false
+	}
+	peerIDs := make([]string, 0, len(providers))
+	for peerID := range providers {
+		peerIDs = append(peerIDs, peerID)
+	}
+	sort.Strings(peerIDs)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.cursors[serviceID] % len(peerIDs)
+	r.cursors[serviceID] = i + 1
+	return peerIDs[i], true
+}
+
+func (r *RoundRobinLoadBalancer) Done(serviceID, peerID string) {}
+
+// LeastLoadedLoadBalancer tracks outstanding streams per peer and always
+// picks the provider with the fewest in-flight requests, skipping any
+// provider already at its advertised types.Service.Capacity.
+type LeastLoadedLoadBalancer struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func NewLeastLoadedLoadBalancer() *LeastLoadedLoadBalancer {
+	return &LeastLoadedLoadBalancer{inFlight: map[string]int{}}
+}
+
+func (l *LeastLoadedLoadBalancer) Pick(serviceID string, providers map[string]types.Service) (string, bool) {
+	if len(providers) == 0 {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var best string
+	bestLoad := -1
+	for peerID, svc := range providers {
+		load := l.inFlight[peerID]
+		if svc.Capacity > 0 && load >= svc.Capacity {
+			continue
+		}
+		if bestLoad == -1 || load < bestLoad {
+			best, bestLoad = peerID, load
+		}
+	}
+	if bestLoad == -1 {
+		return "", false
+	}
+	l.inFlight[best]++
+	return best, true
+}
+
+func (l *LeastLoadedLoadBalancer) Done(serviceID, peerID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[peerID] > 0 {
+		l.inFlight[peerID]--
+	}
+}
+
+// Evict drops bookkeeping for peers that are no longer in the active set,
+// e.g. once they fall out of the healthcheck bucket.
+func (l *LeastLoadedLoadBalancer) Evict(active []string) {
+	alive := map[string]struct{}{}
+	for _, a := range active {
+		alive[a] = struct{}{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for peerID := range l.inFlight {
+		if _, ok := alive[peerID]; !ok {
+			delete(l.inFlight, peerID)
+		}
+	}
+}
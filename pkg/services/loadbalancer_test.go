@@ -0,0 +1,112 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mudler/edgevpn/pkg/edgevpn/types"
+)
+
+func TestRandomLoadBalancerClampsWeight(t *testing.T) {
+	providers := map[string]types.Service{"peer-a": {Weight: math.MaxInt32}}
+
+	peerID, ok := RandomLoadBalancer{}.Pick("svc", providers)
+	if !ok || peerID != "peer-a" {
+		t.Fatalf("Pick() = (%q, %v), want (\"peer-a\", true)", peerID, ok)
+	}
+}
+
+func TestRandomLoadBalancerNoProviders(t *testing.T) {
+	if _, ok := (RandomLoadBalancer{}).Pick("svc", nil); ok {
+		t.Fatal("Pick() with no providers should report false")
+	}
+}
+
+func TestRoundRobinLoadBalancerCycles(t *testing.T) {
+	lb := NewRoundRobinLoadBalancer()
+	providers := map[string]types.Service{"a": {}, "b": {}, "c": {}}
+
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		peerID, ok := lb.Pick("svc", providers)
+		if !ok {
+			t.Fatal("expected a pick")
+		}
+		seen[peerID]++
+	}
+	for peerID, count := range seen {
+		if count != 2 {
+			t.Fatalf("peer %s picked %d times, want 2 for an even rotation", peerID, count)
+		}
+	}
+}
+
+func TestLeastLoadedLoadBalancerPrefersIdlePeer(t *testing.T) {
+	lb := NewLeastLoadedLoadBalancer()
+	providers := map[string]types.Service{"a": {}, "b": {}}
+
+	first, ok := lb.Pick("svc", providers)
+	if !ok {
+		t.Fatal("expected a pick")
+	}
+	second, ok := lb.Pick("svc", providers)
+	if !ok {
+		t.Fatal("expected a pick")
+	}
+	if first == second {
+		t.Fatalf("both picks went to %s even though it already had an in-flight request", first)
+	}
+
+	lb.Done("svc", first)
+	lb.Done("svc", second)
+}
+
+func TestLeastLoadedLoadBalancerRespectsCapacity(t *testing.T) {
+	lb := NewLeastLoadedLoadBalancer()
+	providers := map[string]types.Service{"a": {Capacity: 1}}
+
+	first, ok := lb.Pick("svc", providers)
+	if !ok || first != "a" {
+		t.Fatalf("Pick() = (%q, %v), want (\"a\", true)", first, ok)
+	}
+
+	if _, ok := lb.Pick("svc", providers); ok {
+		t.Fatal("Pick() should report false once the only provider is at capacity")
+	}
+
+	lb.Done("svc", "a")
+	if _, ok := lb.Pick("svc", providers); !ok {
+		t.Fatal("expected a pick once the provider freed up a slot")
+	}
+}
+
+func TestLeastLoadedLoadBalancerEvictDropsVanishedPeers(t *testing.T) {
+	lb := NewLeastLoadedLoadBalancer()
+	if _, ok := lb.Pick("svc", map[string]types.Service{"a": {}}); !ok {
+		t.Fatal("expected a pick")
+	}
+
+	lb.Evict(nil) // "a" is no longer in the active set
+
+	lb.mu.Lock()
+	_, tracked := lb.inFlight["a"]
+	lb.mu.Unlock()
+	if tracked {
+		t.Fatal("Evict should have dropped bookkeeping for a peer no longer in the active set")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"sort"
+)
+
+// Leader deterministically picks one peer out of nodes by hashing each
+// candidate and choosing the smallest digest, so every peer computes the
+// same answer from the same nodes slice without any coordination. It is
+// gameable by a peer that controls its own ID, which is why
+// services.Alive prefers a drand-backed election when one is configured.
+func Leader(nodes []string) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), nodes...)
+	sort.Strings(sorted)
+
+	var best string
+	var bestHash [sha256.Size]byte
+	first := true
+	for _, peerID := range sorted {
+		h := sha256.Sum256([]byte(peerID))
+		if first || string(h[:]) < string(bestHash[:]) {
+			best, bestHash, first = peerID, h, false
+		}
+	}
+	return best
+}